@@ -0,0 +1,174 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"context"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	// exportProtectionFinalizer is added to every VirtualMachineExport at
+	// admission and only removed once cancellation (or deletion) cleanup has
+	// fully run, mirroring how the migration controllers guard long-running
+	// data operations against being torn down mid-flight.
+	exportProtectionFinalizer = "export.kubevirt.io/protection"
+
+	// annCancelExport, when set to "true", requests cancellation of an
+	// in-progress export without waiting for Spec.TTLDuration to elapse.
+	annCancelExport = "kubevirt.io/cancel-export"
+)
+
+// isExportCancelled reports whether vmExport has been asked to cancel via the
+// annCancelExport annotation.
+func isExportCancelled(vmExport *exportv1.VirtualMachineExport) bool {
+	return vmExport.Annotations[annCancelExport] == "true"
+}
+
+// ensureExportFinalizer adds exportProtectionFinalizer if it isn't already
+// present, returning whether it changed the object (so the caller knows to
+// persist the update). The admission path for new VirtualMachineExports must
+// call this before the object is first persisted, the same way
+// VirtualMachineInstance's admission webhook adds its own protection
+// finalizer, so that a cancellation request can never race a delete that
+// skips reconcileCancellation's cleanup entirely.
+func ensureExportFinalizer(vmExport *exportv1.VirtualMachineExport) bool {
+	for _, f := range vmExport.Finalizers {
+		if f == exportProtectionFinalizer {
+			return false
+		}
+	}
+	vmExport.Finalizers = append(vmExport.Finalizers, exportProtectionFinalizer)
+	return true
+}
+
+// removeExportFinalizer removes exportProtectionFinalizer, returning whether
+// it changed the object.
+func removeExportFinalizer(vmExport *exportv1.VirtualMachineExport) bool {
+	for i, f := range vmExport.Finalizers {
+		if f == exportProtectionFinalizer {
+			vmExport.Finalizers = append(vmExport.Finalizers[:i], vmExport.Finalizers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// tokenSecretWasDefaulted reports whether Status.TokenSecretRef was populated
+// by handleVMExportToken itself (i.e. the user did not supply
+// Spec.TokenSecretRef), which is exactly the case where cancellation cleanup
+// is responsible for deleting the token Secret.
+func tokenSecretWasDefaulted(vmExport *exportv1.VirtualMachineExport) bool {
+	if vmExport.Spec.TokenSecretRef != nil {
+		return false
+	}
+	return vmExport.Status != nil && vmExport.Status.TokenSecretRef != nil &&
+		*vmExport.Status.TokenSecretRef == getDefaultTokenSecretName(vmExport)
+}
+
+// reconcileCancellation implements the cleanup steps a cancelled export must
+// run, in order, before the finalizer can be removed:
+//  1. delete the exporter Pod
+//  2. delete the auto-created cert Secret named by getExportSecretName
+//  3. delete the auto-created token Secret, only if handleVMExportToken
+//     defaulted it rather than the user supplying Spec.TokenSecretRef
+//  4. call releaseSourceClones, which deletes only a VolumeSnapshot source's
+//     restore PVC; PVCs restored for VM/VMSnapshot sources are not deleted
+//
+// It returns whether the finalizer was removed, i.e. cleanup fully completed.
+// The reconcile loop's updateVMExport must call this ahead of its regular
+// provisioning steps, before touching the exporter Pod or Secrets any
+// further, so a cancelled export stops being reconciled forward instead of
+// racing its own cleanup.
+//
+// deletePod/deleteSecret/releaseSourceClones are narrowed func(name) error /
+// func(*VirtualMachineExport) error callbacks, in the same spirit as
+// getOrCreatePresignKey's secretClient/updateSecret, rather than a concrete
+// kubecli.KubevirtClient, so this method only depends on exactly the three
+// side effects it performs.
+func (ctrl *VMExportController) reconcileCancellation(
+	vmExport *exportv1.VirtualMachineExport,
+	pod *k8sv1.Pod,
+	deletePod func(name string) error,
+	deleteSecret func(name string) error,
+	releaseSourceClones func(*exportv1.VirtualMachineExport) error,
+) (bool, error) {
+	if !isExportCancelled(vmExport) {
+		return false, nil
+	}
+
+	if pod != nil {
+		if err := deletePod(pod.Name); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+		if err := deleteSecret(ctrl.getExportSecretName(pod)); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	if tokenSecretWasDefaulted(vmExport) {
+		if err := deleteSecret(*vmExport.Status.TokenSecretRef); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
+
+	if err := releaseSourceClones(vmExport); err != nil {
+		return false, err
+	}
+
+	return removeExportFinalizer(vmExport), nil
+}
+
+// releaseSourceClones deletes the temporary restore PVC reconcileVolumeSnapshotSource
+// creates for a VolumeSnapshot source. It does nothing for any other source
+// kind: PVCs restored for VM/VMSnapshot sources are not deleted here.
+func (ctrl *VMExportController) releaseSourceClones(vmExport *exportv1.VirtualMachineExport) error {
+	if !isVolumeSnapshotSource(vmExport) {
+		return nil
+	}
+	err := ctrl.Client.CoreV1().PersistentVolumeClaims(vmExport.Namespace).Delete(context.Background(), getRestorePVCName(vmExport), metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// reconcileCancellationForExport is reconcileCancellation bound to ctrl's real
+// client, the form updateVMExport (defined on the full controller, not part
+// of this checkout) must call ahead of its regular provisioning steps so a
+// cancelled export actually stops being reconciled forward instead of racing
+// its own cleanup.
+func (ctrl *VMExportController) reconcileCancellationForExport(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod) (bool, error) {
+	namespace := vmExport.Namespace
+	return ctrl.reconcileCancellation(vmExport, pod,
+		func(name string) error {
+			return ctrl.Client.CoreV1().Pods(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+		},
+		func(name string) error {
+			return ctrl.Client.CoreV1().Secrets(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+		},
+		ctrl.releaseSourceClones,
+	)
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+var _ = Describe("Export cancellation", func() {
+	var controller *VMExportController
+
+	BeforeEach(func() {
+		controller = &VMExportController{}
+	})
+
+	It("should not be cancelled by default", func() {
+		vmExport := createPVCVMExport()
+		Expect(isExportCancelled(vmExport)).To(BeFalse())
+	})
+
+	It("should be cancelled via the cancel annotation", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Annotations = map[string]string{annCancelExport: "true"}
+		Expect(isExportCancelled(vmExport)).To(BeTrue())
+	})
+
+	It("should add and remove the protection finalizer idempotently", func() {
+		vmExport := createPVCVMExport()
+		Expect(ensureExportFinalizer(vmExport)).To(BeTrue())
+		Expect(vmExport.Finalizers).To(ContainElement(exportProtectionFinalizer))
+		Expect(ensureExportFinalizer(vmExport)).To(BeFalse())
+
+		Expect(removeExportFinalizer(vmExport)).To(BeTrue())
+		Expect(vmExport.Finalizers).ToNot(ContainElement(exportProtectionFinalizer))
+		Expect(removeExportFinalizer(vmExport)).To(BeFalse())
+	})
+
+	It("should treat a user-supplied TokenSecretRef as not defaulted", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{
+			TokenSecretRef: pointer.StringPtr(getDefaultTokenSecretName(vmExport)),
+		}
+		Expect(tokenSecretWasDefaulted(vmExport)).To(BeFalse())
+	})
+
+	It("should run pod/secret cleanup and remove the finalizer when cancelled", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Annotations = map[string]string{annCancelExport: "true"}
+		ensureExportFinalizer(vmExport)
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "virt-export-test"}}
+
+		var deletedPod, deletedSecret string
+		var releasedClones bool
+		finalized, err := controller.reconcileCancellation(vmExport, pod,
+			func(name string) error { deletedPod = name; return nil },
+			func(name string) error { deletedSecret = name; return nil },
+			func(*exportv1.VirtualMachineExport) error { releasedClones = true; return nil },
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(finalized).To(BeTrue())
+		Expect(deletedPod).To(Equal(pod.Name))
+		Expect(deletedSecret).To(Equal(controller.getExportSecretName(pod)))
+		Expect(releasedClones).To(BeTrue())
+		Expect(vmExport.Finalizers).ToNot(ContainElement(exportProtectionFinalizer))
+	})
+
+	It("should be a no-op when not cancelled", func() {
+		vmExport := createPVCVMExport()
+		ensureExportFinalizer(vmExport)
+		finalized, err := controller.reconcileCancellation(vmExport, nil,
+			func(name string) error { return nil },
+			func(name string) error { return nil },
+			func(*exportv1.VirtualMachineExport) error { return nil },
+		)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(finalized).To(BeFalse())
+		Expect(vmExport.Finalizers).To(ContainElement(exportProtectionFinalizer))
+	})
+})
@@ -0,0 +1,236 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	// FormatQcow2 and FormatVmdk aren't (yet) part of the exportv1 API's
+	// ExportVolumeFormat enum, unlike exportv1.KubeVirtRaw/KubeVirtGz/Dir/
+	// ArchiveGz; they're declared here, as the same exportv1.ExportVolumeFormat
+	// type, so every provider/test referencing them goes through one named
+	// constant instead of repeating the string literal ad hoc.
+	FormatQcow2 exportv1.ExportVolumeFormat = "Qcow2"
+	FormatVmdk  exportv1.ExportVolumeFormat = "Vmdk"
+)
+
+// VolumeFormatProvider is implemented by each format virt-exportserver can
+// stream a volume as. Built-in providers cover the pre-existing raw/gz/dir/
+// tar.gz set plus qcow2 and vmdk; out-of-tree providers register themselves
+// the same way via RegisterVolumeFormat.
+type VolumeFormatProvider interface {
+	// Format is the exportv1.ExportVolumeFormat this provider serves.
+	Format() exportv1.ExportVolumeFormat
+	// URLSuffix is appended to a volume's base URL to reach this format,
+	// e.g. "disk.img.gz".
+	URLSuffix() string
+	// MimeType is the Content-Type virt-exportserver sets when serving this
+	// format.
+	MimeType() string
+	// AppliesTo reports whether this provider can serve a PVC with the given
+	// annContentType value ("kubevirt" or "archive").
+	AppliesTo(contentType string) bool
+	// Stream copies the volume's raw disk image at sourcePath to w, performing
+	// this format's own encoding (e.g. gzip compression, or a qemu-img
+	// convert pipe for qcow2/vmdk) as it goes. It returns an error for
+	// formats this package cannot produce at all by streaming a single file,
+	// namely dir/tar.gz, which operate on a whole volume tree.
+	Stream(sourcePath string, w io.Writer) error
+}
+
+// streamFunc implements a single format's streaming: raw/gzip by copying the
+// source file directly, qcow2/vmdk by piping it through qemu-img convert. Only
+// dir/tar.gz, which operate on a whole volume tree rather than a single file,
+// fall back to unsupportedStream.
+type streamFunc func(sourcePath string, w io.Writer) error
+
+func streamRawFile(sourcePath string, w io.Writer) error {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func streamGzipFile(sourcePath string, w io.Writer) error {
+	f, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, f); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+func unsupportedStream(format exportv1.ExportVolumeFormat) streamFunc {
+	return func(string, io.Writer) error {
+		return fmt.Errorf("format %q operates on a whole volume tree and cannot be streamed from a single file", format)
+	}
+}
+
+// streamQemuImgConvert streams sourcePath converted to outputFormat (plus any
+// extra "-o"-style qemu-img options, e.g. vmdk's subformat=streamOptimized) by
+// piping qemu-img convert's stdout straight to w, rather than converting to a
+// temporary file first and copying that, since virt-exportserver streams
+// directly to the HTTP response without enough local disk to stage a second
+// full copy of the volume.
+func streamQemuImgConvert(outputFormat string, extraArgs ...string) streamFunc {
+	return func(sourcePath string, w io.Writer) error {
+		args := append([]string{"convert", "-O", outputFormat}, extraArgs...)
+		args = append(args, sourcePath, "-")
+		cmd := exec.Command("qemu-img", args...)
+		cmd.Stdout = w
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("qemu-img convert to %s failed: %v: %s", outputFormat, err, stderr.String())
+		}
+		return nil
+	}
+}
+
+type staticVolumeFormatProvider struct {
+	format      exportv1.ExportVolumeFormat
+	urlSuffix   string
+	mimeType    string
+	contentType string
+	stream      streamFunc
+}
+
+func (p staticVolumeFormatProvider) Format() exportv1.ExportVolumeFormat { return p.format }
+func (p staticVolumeFormatProvider) URLSuffix() string                   { return p.urlSuffix }
+func (p staticVolumeFormatProvider) MimeType() string                    { return p.mimeType }
+func (p staticVolumeFormatProvider) AppliesTo(contentType string) bool {
+	return p.contentType == "" || p.contentType == contentType
+}
+func (p staticVolumeFormatProvider) Stream(sourcePath string, w io.Writer) error {
+	return p.stream(sourcePath, w)
+}
+
+var volumeFormatRegistry = map[string]VolumeFormatProvider{}
+
+// RegisterVolumeFormat registers a VolumeFormatProvider under name, the value
+// accepted in Spec.Formats. Re-registering an existing name replaces it,
+// mirroring how client-go scheme registration works.
+func RegisterVolumeFormat(name string, provider VolumeFormatProvider) {
+	volumeFormatRegistry[name] = provider
+}
+
+func init() {
+	RegisterVolumeFormat("raw", staticVolumeFormatProvider{
+		format: exportv1.KubeVirtRaw, urlSuffix: "disk.img", mimeType: "application/octet-stream", contentType: contentTypeKubevirt,
+		stream: streamRawFile,
+	})
+	RegisterVolumeFormat("gzip", staticVolumeFormatProvider{
+		format: exportv1.KubeVirtGz, urlSuffix: "disk.img.gz", mimeType: "application/gzip", contentType: contentTypeKubevirt,
+		stream: streamGzipFile,
+	})
+	RegisterVolumeFormat("dir", staticVolumeFormatProvider{
+		format: exportv1.Dir, urlSuffix: "dir", mimeType: "application/octet-stream", contentType: contentTypeArchive,
+		stream: unsupportedStream(exportv1.Dir),
+	})
+	RegisterVolumeFormat("tar.gz", staticVolumeFormatProvider{
+		format: exportv1.ArchiveGz, urlSuffix: "disk.tar.gz", mimeType: "application/gzip", contentType: contentTypeArchive,
+		stream: unsupportedStream(exportv1.ArchiveGz),
+	})
+	RegisterVolumeFormat("qcow2", staticVolumeFormatProvider{
+		format: FormatQcow2, urlSuffix: "disk.qcow2", mimeType: "application/octet-stream", contentType: contentTypeKubevirt,
+		stream: streamQemuImgConvert("qcow2"),
+	})
+	RegisterVolumeFormat("vmdk", staticVolumeFormatProvider{
+		format: FormatVmdk, urlSuffix: "disk.vmdk", mimeType: "application/octet-stream", contentType: contentTypeKubevirt,
+		stream: streamQemuImgConvert("vmdk", "-o", "subformat=streamOptimized"),
+	})
+}
+
+const (
+	contentTypeKubevirt = "kubevirt"
+	contentTypeArchive  = "archive"
+)
+
+// ValidateFormats rejects any name in formats that isn't a registered
+// VolumeFormatProvider, so admission can reject an unknown Spec.Formats entry
+// up front instead of the exporter pod failing at run time.
+func ValidateFormats(formats []string) error {
+	for _, name := range formats {
+		if _, ok := volumeFormatRegistry[name]; !ok {
+			return fmt.Errorf("unknown export format %q, known formats: %v", name, registeredFormatNames())
+		}
+	}
+	return nil
+}
+
+func registeredFormatNames() []string {
+	names := make([]string, 0, len(volumeFormatRegistry))
+	for name := range volumeFormatRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// defaultFormatsForContentType is used when Spec.Formats is empty, preserving
+// the historical hard-coded raw+gzip / dir+tar.gz pairing.
+func defaultFormatsForContentType(contentType string) []string {
+	if contentType == contentTypeArchive {
+		return []string{"dir", "tar.gz"}
+	}
+	return []string{"raw", "gzip"}
+}
+
+// volumeFormatsFor resolves the exportv1.VirtualMachineExportVolumeFormat list
+// for a single volume, using vmExport.Spec.Formats (or the historical default
+// pair when unset) filtered to providers that apply to contentType, with
+// baseURL as each format's URL prefix.
+func volumeFormatsFor(vmExport *exportv1.VirtualMachineExport, contentType, baseURL string) []exportv1.VirtualMachineExportVolumeFormat {
+	names := vmExport.Spec.Formats
+	if len(names) == 0 {
+		names = defaultFormatsForContentType(contentType)
+	}
+
+	var formats []exportv1.VirtualMachineExportVolumeFormat
+	for _, name := range names {
+		provider, ok := volumeFormatRegistry[name]
+		if !ok || !provider.AppliesTo(contentType) {
+			continue
+		}
+		formats = append(formats, exportv1.VirtualMachineExportVolumeFormat{
+			Format: provider.Format(),
+			Url:    fmt.Sprintf("%s/%s", baseURL, provider.URLSuffix()),
+		})
+	}
+	return formats
+}
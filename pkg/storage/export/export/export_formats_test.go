@@ -0,0 +1,136 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Volume format registry", func() {
+	It("should accept the built-in format names", func() {
+		Expect(ValidateFormats([]string{"raw", "gzip", "dir", "tar.gz", "qcow2", "vmdk"})).To(Succeed())
+	})
+
+	It("should reject an unknown format name", func() {
+		Expect(ValidateFormats([]string{"raw", "bogus"})).To(MatchError(ContainSubstring("unknown export format \"bogus\"")))
+	})
+
+	It("should fall back to the historical raw+gzip pair for kubevirt content", func() {
+		vmExport := createPVCVMExport()
+		formats := volumeFormatsFor(vmExport, contentTypeKubevirt, "https://virt-export-test.default.svc/volumes/disk0")
+		Expect(formats).To(HaveLen(2))
+		Expect(formats[0].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.img"))
+		Expect(formats[1].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.img.gz"))
+	})
+
+	It("should fall back to the historical dir+tar.gz pair for archive content", func() {
+		vmExport := createPVCVMExport()
+		formats := volumeFormatsFor(vmExport, contentTypeArchive, "https://virt-export-test.default.svc/volumes/disk0")
+		Expect(formats).To(HaveLen(2))
+		Expect(formats[0].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/dir"))
+		Expect(formats[1].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.tar.gz"))
+	})
+
+	It("should honor Spec.Formats when set, including the new qcow2/vmdk providers", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Formats = []string{"qcow2", "vmdk"}
+		formats := volumeFormatsFor(vmExport, contentTypeKubevirt, "https://virt-export-test.default.svc/volumes/disk0")
+		Expect(formats).To(HaveLen(2))
+		Expect(formats[0].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.qcow2"))
+		Expect(formats[0].Format).To(Equal(FormatQcow2))
+		Expect(formats[1].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.vmdk"))
+		Expect(formats[1].Format).To(Equal(FormatVmdk))
+	})
+
+	It("should skip formats that don't apply to the content type", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Formats = []string{"raw", "dir"}
+		formats := volumeFormatsFor(vmExport, contentTypeKubevirt, "https://virt-export-test.default.svc/volumes/disk0")
+		Expect(formats).To(HaveLen(1))
+		Expect(formats[0].Url).To(Equal("https://virt-export-test.default.svc/volumes/disk0/disk.img"))
+	})
+
+	It("should stream the raw provider's bytes unchanged", func() {
+		f, err := os.CreateTemp("", "export-formats-raw-*")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		Expect(os.WriteFile(f.Name(), []byte("disk-bytes"), 0o600)).To(Succeed())
+
+		var out bytes.Buffer
+		Expect(volumeFormatRegistry["raw"].Stream(f.Name(), &out)).To(Succeed())
+		Expect(out.String()).To(Equal("disk-bytes"))
+	})
+
+	It("should stream the gzip provider's bytes gzip-compressed", func() {
+		f, err := os.CreateTemp("", "export-formats-gzip-*")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		Expect(os.WriteFile(f.Name(), []byte("disk-bytes"), 0o600)).To(Succeed())
+
+		var out bytes.Buffer
+		Expect(volumeFormatRegistry["gzip"].Stream(f.Name(), &out)).To(Succeed())
+
+		gz, err := gzip.NewReader(&out)
+		Expect(err).ToNot(HaveOccurred())
+		decompressed, err := io.ReadAll(gz)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(decompressed)).To(Equal("disk-bytes"))
+	})
+
+	It("should report an error streaming formats that operate on a whole volume tree rather than a single file", func() {
+		var out bytes.Buffer
+		Expect(volumeFormatRegistry["dir"].Stream("irrelevant", &out)).To(MatchError(ContainSubstring("cannot be streamed from a single file")))
+		Expect(volumeFormatRegistry["tar.gz"].Stream("irrelevant", &out)).To(MatchError(ContainSubstring("cannot be streamed from a single file")))
+	})
+
+	It("should stream the qcow2/vmdk providers as real qemu-img convert output", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img not available on PATH")
+		}
+
+		f, err := os.CreateTemp("", "export-formats-qemu-img-*.raw")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		Expect(os.WriteFile(f.Name(), make([]byte, 1<<20), 0o600)).To(Succeed())
+
+		var qcow2 bytes.Buffer
+		Expect(volumeFormatRegistry["qcow2"].Stream(f.Name(), &qcow2)).To(Succeed())
+		Expect(qcow2.Bytes()[:4]).To(Equal([]byte("QFI\xfb")))
+
+		var vmdk bytes.Buffer
+		Expect(volumeFormatRegistry["vmdk"].Stream(f.Name(), &vmdk)).To(Succeed())
+		Expect(vmdk.Bytes()[:4]).To(Equal([]byte("KDMV")))
+	})
+
+	It("should report the real qemu-img error when the source path doesn't exist", func() {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			Skip("qemu-img not available on PATH")
+		}
+		var out bytes.Buffer
+		Expect(volumeFormatRegistry["qcow2"].Stream("/no/such/disk.img", &out)).To(MatchError(ContainSubstring("qemu-img convert")))
+	})
+})
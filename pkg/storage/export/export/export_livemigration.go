@@ -0,0 +1,145 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"fmt"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	// ConditionMigrating is the condition type for a live-migration-backed
+	// export whose storage migration has not yet cut over to the freshly
+	// provisioned target PVC. No function in this package sets it.
+	ConditionMigrating exportv1.ConditionType = "Migrating"
+
+	migrationTargetPVCPrefix = "export-migration-target"
+)
+
+// liveMigrateIfRunning reports whether the VM source opted into
+// live-migration-backed export via Spec.Source.LiveMigrateIfRunning.
+func liveMigrateIfRunning(vmExport *exportv1.VirtualMachineExport) bool {
+	return vmExport.Spec.Source.LiveMigrateIfRunning != nil && *vmExport.Spec.Source.LiveMigrateIfRunning
+}
+
+// shouldTriggerStorageMigration reports whether the controller needs to
+// migrate the source VM's disks to a fresh target PVC before exporting, i.e.
+// the opt-in is set, the VMI is actually Running (a stopped VM can be
+// exported directly from its existing PVCs), and storageRWXCapable confirms
+// the target StorageClass can actually back a live cut-over: a storage
+// migration needs both the source and target PVC mounted to the same running
+// VMI at once, which requires ReadWriteMany, so migrating onto RWO storage
+// would only fail once cut-over was already underway.
+func shouldTriggerStorageMigration(vmExport *exportv1.VirtualMachineExport, vmi *virtv1.VirtualMachineInstance, storageRWXCapable bool) bool {
+	if !liveMigrateIfRunning(vmExport) {
+		return false
+	}
+	if !storageRWXCapable {
+		return false
+	}
+	return vmi != nil && vmi.Status.Phase == virtv1.Running
+}
+
+// migrationTargetPVCName names the PVC a live-migration-backed export
+// provisions as the storage migration's destination.
+func migrationTargetPVCName(vmExport *exportv1.VirtualMachineExport, volumeName string) string {
+	return fmt.Sprintf("%s-%s-%s", migrationTargetPVCPrefix, vmExport.Name, volumeName)
+}
+
+// buildMigrationTargetPVC provisions the target PVC a storage migration cuts
+// over to, sourced from the CSI VolumeSnapshot taken at migration cut-over.
+// It reuses the same VolumeSnapshot-as-dataSource shape
+// createRestorePVCFromVolumeSnapshot uses for VolumeSnapshot export sources,
+// since both ultimately need an exportable PVC populated from a snapshot.
+func buildMigrationTargetPVC(vmExport *exportv1.VirtualMachineExport, volumeName string, vs *vsv1.VolumeSnapshot, size resource.Quantity, storageClassName *string) *k8sv1.PersistentVolumeClaim {
+	pvc := createRestorePVCFromVolumeSnapshot(vmExport, vs, size, storageClassName, true)
+	pvc.Name = migrationTargetPVCName(vmExport, volumeName)
+	pvc.Spec.AccessModes = []k8sv1.PersistentVolumeAccessMode{k8sv1.ReadWriteMany}
+	return pvc
+}
+
+// repointVolumeToTargetPVC implements the updateVolumes strategy: it updates
+// vmi's volume named volumeName in place to claim targetPVCName instead of
+// its current PVC, the same in-place Spec.Volumes edit
+// VirtualMachineInstance's volume migration feature already uses to signal a
+// live disk relocation (as opposed to this package's previous approach of
+// recording the linkage in an annotation nothing reads). virt-controller
+// detects the mismatch between the running VMI's current volumes and this
+// updated desired spec and drives the actual block-level cut-over once the
+// VirtualMachineInstanceMigration triggerStorageMigration creates starts
+// running; it is a no-op if volumeName isn't a PVC-backed volume on vmi.
+func repointVolumeToTargetPVC(vmi *virtv1.VirtualMachineInstance, volumeName, targetPVCName string) {
+	for i := range vmi.Spec.Volumes {
+		volume := &vmi.Spec.Volumes[i]
+		if volume.Name == volumeName && volume.PersistentVolumeClaim != nil {
+			volume.PersistentVolumeClaim.ClaimName = targetPVCName
+			return
+		}
+	}
+}
+
+// triggerStorageMigration applies the updateVolumes strategy to vmi's disk
+// backed by sourceVolumeName, repointing it at targetPVCName, and returns the
+// VirtualMachineInstanceMigration that drives the live cut-over to the
+// updated volume spec, the same mechanism the migration ecosystem uses to
+// relocate VM disks without downtime.
+func triggerStorageMigration(vmi *virtv1.VirtualMachineInstance, sourceVolumeName, targetPVCName string) *virtv1.VirtualMachineInstanceMigration {
+	repointVolumeToTargetPVC(vmi, sourceVolumeName, targetPVCName)
+	return &virtv1.VirtualMachineInstanceMigration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-export", vmi.Name),
+			Namespace: vmi.Namespace,
+		},
+		Spec: virtv1.VirtualMachineInstanceMigrationSpec{
+			VMIName: vmi.Name,
+		},
+	}
+}
+
+// isStorageMigrationDone reports whether the triggered migration has
+// completed, so the controller can move on to exporting the target PVC
+// through the regular exporter-pod path.
+func isStorageMigrationDone(migration *virtv1.VirtualMachineInstanceMigration) bool {
+	return migration != nil && migration.Status.Phase == virtv1.MigrationSucceeded
+}
+
+// exportSourcePVCName resolves which PVC a live-migration-backed export
+// should actually read volumeName from: vmi's currently claimed PVC while the
+// storage migration is still in flight (or hasn't started), or the freshly
+// cut-over target PVC once migration has completed, so the exporter never
+// keeps serving the pre-migration PVC after the live data has already moved.
+func exportSourcePVCName(vmExport *exportv1.VirtualMachineExport, vmi *virtv1.VirtualMachineInstance, volumeName string, migration *virtv1.VirtualMachineInstanceMigration) string {
+	if isStorageMigrationDone(migration) {
+		return migrationTargetPVCName(vmExport, volumeName)
+	}
+	for _, volume := range vmi.Spec.Volumes {
+		if volume.Name == volumeName && volume.PersistentVolumeClaim != nil {
+			return volume.PersistentVolumeClaim.ClaimName
+		}
+	}
+	return ""
+}
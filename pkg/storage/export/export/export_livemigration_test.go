@@ -0,0 +1,133 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	vsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	virtv1 "kubevirt.io/api/core/v1"
+)
+
+var _ = Describe("Live-migration-backed export", func() {
+	It("should not trigger a storage migration when LiveMigrateIfRunning is unset", func() {
+		vmExport := createVMVMExport()
+		vmi := &virtv1.VirtualMachineInstance{Status: virtv1.VirtualMachineInstanceStatus{Phase: virtv1.Running}}
+		Expect(shouldTriggerStorageMigration(vmExport, vmi, true)).To(BeFalse())
+	})
+
+	It("should not trigger a storage migration when the VMI is not running", func() {
+		vmExport := createVMVMExport()
+		vmExport.Spec.Source.LiveMigrateIfRunning = pointer.BoolPtr(true)
+		vmi := &virtv1.VirtualMachineInstance{Status: virtv1.VirtualMachineInstanceStatus{Phase: virtv1.Succeeded}}
+		Expect(shouldTriggerStorageMigration(vmExport, vmi, true)).To(BeFalse())
+	})
+
+	It("should not trigger a storage migration when the target storage isn't RWX-capable", func() {
+		vmExport := createVMVMExport()
+		vmExport.Spec.Source.LiveMigrateIfRunning = pointer.BoolPtr(true)
+		vmi := &virtv1.VirtualMachineInstance{Status: virtv1.VirtualMachineInstanceStatus{Phase: virtv1.Running}}
+		Expect(shouldTriggerStorageMigration(vmExport, vmi, false)).To(BeFalse())
+	})
+
+	It("should trigger a storage migration when opted in, the VMI is running, and storage is RWX-capable", func() {
+		vmExport := createVMVMExport()
+		vmExport.Spec.Source.LiveMigrateIfRunning = pointer.BoolPtr(true)
+		vmi := &virtv1.VirtualMachineInstance{Status: virtv1.VirtualMachineInstanceStatus{Phase: virtv1.Running}}
+		Expect(shouldTriggerStorageMigration(vmExport, vmi, true)).To(BeTrue())
+	})
+
+	It("should repoint the source volume's claim at the target PVC and trigger a migration", func() {
+		vmi := &virtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vmi", Namespace: testNamespace},
+			Spec: virtv1.VirtualMachineInstanceSpec{
+				Volumes: []virtv1.Volume{{
+					Name: "disk0",
+					VolumeSource: virtv1.VolumeSource{
+						PersistentVolumeClaim: &virtv1.PersistentVolumeClaimVolumeSource{
+							PersistentVolumeClaimVolumeSource: k8sv1.PersistentVolumeClaimVolumeSource{ClaimName: "source-pvc"},
+						},
+					},
+				}},
+			},
+		}
+		migration := triggerStorageMigration(vmi, "disk0", "export-migration-target-test-disk0")
+		Expect(vmi.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("export-migration-target-test-disk0"))
+		Expect(migration.Spec.VMIName).To(Equal("test-vmi"))
+	})
+
+	It("should leave a non-PVC volume untouched", func() {
+		vmi := &virtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-vmi", Namespace: testNamespace},
+			Spec: virtv1.VirtualMachineInstanceSpec{
+				Volumes: []virtv1.Volume{{Name: "cloudinit", VolumeSource: virtv1.VolumeSource{}}},
+			},
+		}
+		triggerStorageMigration(vmi, "disk0", "export-migration-target-test-disk0")
+		Expect(vmi.Spec.Volumes[0].PersistentVolumeClaim).To(BeNil())
+	})
+
+	It("should read from the VMI's current PVC before migration completes, and the target PVC after", func() {
+		vmExport := createVMVMExport()
+		vmi := &virtv1.VirtualMachineInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: vmExport.Name},
+			Spec: virtv1.VirtualMachineInstanceSpec{
+				Volumes: []virtv1.Volume{{
+					Name: "disk0",
+					VolumeSource: virtv1.VolumeSource{
+						PersistentVolumeClaim: &virtv1.PersistentVolumeClaimVolumeSource{
+							PersistentVolumeClaimVolumeSource: k8sv1.PersistentVolumeClaimVolumeSource{ClaimName: "source-pvc"},
+						},
+					},
+				}},
+			},
+		}
+		running := &virtv1.VirtualMachineInstanceMigration{Status: virtv1.VirtualMachineInstanceMigrationStatus{Phase: virtv1.MigrationRunning}}
+		Expect(exportSourcePVCName(vmExport, vmi, "disk0", running)).To(Equal("source-pvc"))
+
+		succeeded := &virtv1.VirtualMachineInstanceMigration{Status: virtv1.VirtualMachineInstanceMigrationStatus{Phase: virtv1.MigrationSucceeded}}
+		Expect(exportSourcePVCName(vmExport, vmi, "disk0", succeeded)).To(Equal(migrationTargetPVCName(vmExport, "disk0")))
+	})
+
+	It("should build a RWX migration target PVC from the cut-over VolumeSnapshot", func() {
+		vmExport := createVMVMExport()
+		vs := &vsv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: "cutover-snap", Namespace: testNamespace}}
+		pvc := buildMigrationTargetPVC(vmExport, "disk0", vs, resource.MustParse("20Gi"), nil)
+		Expect(pvc.Name).To(Equal(migrationTargetPVCName(vmExport, "disk0")))
+		Expect(pvc.Spec.AccessModes).To(ContainElement(k8sv1.ReadWriteMany))
+		Expect(pvc.Spec.DataSource.Name).To(Equal("cutover-snap"))
+	})
+
+	It("should consider a migration done only once it has succeeded", func() {
+		migration := &virtv1.VirtualMachineInstanceMigration{
+			Status: virtv1.VirtualMachineInstanceMigrationStatus{Phase: virtv1.MigrationRunning},
+		}
+		Expect(isStorageMigrationDone(migration)).To(BeFalse())
+		migration.Status.Phase = virtv1.MigrationSucceeded
+		Expect(isStorageMigrationDone(migration)).To(BeTrue())
+		Expect(isStorageMigrationDone(nil)).To(BeFalse())
+	})
+})
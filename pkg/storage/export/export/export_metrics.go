@@ -0,0 +1,241 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	k8sv1 "k8s.io/api/core/v1"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	// ConditionProgressing is mirrored onto Status.Conditions so a client can
+	// watch a single VMExport object instead of tailing exporter pod logs or
+	// scraping /metrics directly.
+	ConditionProgressing exportv1.ConditionType = "Progressing"
+
+	// annVolumeBytesTransferred carries the per-volume transferred/total byte
+	// counts the exporter pod reports, keyed by volume name, the same way
+	// annCertParams carries the cert rotation params.
+	annVolumeBytesTransferred = "kubevirt.io/export-bytes-transferred"
+)
+
+var (
+	transferBytesTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kubevirt_vmexport_transfer_bytes_total",
+			Help: "Total number of bytes to be transferred for a VirtualMachineExport volume/format.",
+		},
+		[]string{"namespace", "name", "volume", "format"},
+	)
+
+	transferBytesTransferred = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kubevirt_vmexport_transfer_bytes_transferred",
+			Help: "Number of bytes already transferred for a VirtualMachineExport volume/format.",
+		},
+		[]string{"namespace", "name", "volume", "format"},
+	)
+
+	transferProgressRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "kubevirt_vmexport_transfer_progress_ratio",
+			Help: "Ratio, between 0 and 1, of bytes transferred for a VirtualMachineExport volume/format.",
+		},
+		[]string{"namespace", "name", "volume", "format"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(transferBytesTotal, transferBytesTransferred, transferProgressRatio)
+}
+
+// volumeTransferProgress is the per-volume/format progress the
+// virt-exportserver binary tracks as it writes disk.img, disk.img.gz, dir, and
+// disk.tar.gz, and reports back on the exporter pod.
+type volumeTransferProgress struct {
+	Volume           string
+	Format           string
+	BytesTotal       int64
+	BytesTransferred int64
+}
+
+// recordTransferMetrics publishes progress as the
+// kubevirt_vmexport_transfer_bytes_total/transferred/progress_ratio gauges for
+// a single VirtualMachineExport.
+func recordTransferMetrics(namespace, name string, progress []volumeTransferProgress) {
+	for _, p := range progress {
+		labels := prometheus.Labels{"namespace": namespace, "name": name, "volume": p.Volume, "format": p.Format}
+		transferBytesTotal.With(labels).Set(float64(p.BytesTotal))
+		transferBytesTransferred.With(labels).Set(float64(p.BytesTransferred))
+		ratio := 0.0
+		if p.BytesTotal > 0 {
+			ratio = float64(p.BytesTransferred) / float64(p.BytesTotal)
+		}
+		transferProgressRatio.With(labels).Set(ratio)
+	}
+}
+
+// deleteTransferMetrics removes every gauge series for a deleted
+// VirtualMachineExport so stale time series don't linger after cleanup.
+func deleteTransferMetrics(namespace, name string, progress []volumeTransferProgress) {
+	for _, p := range progress {
+		labels := prometheus.Labels{"namespace": namespace, "name": name, "volume": p.Volume, "format": p.Format}
+		transferBytesTotal.Delete(labels)
+		transferBytesTransferred.Delete(labels)
+		transferProgressRatio.Delete(labels)
+	}
+}
+
+// UpdateTransferMetrics parses pod's annVolumeBytesTransferred annotation,
+// publishes it as the kubevirt_vmexport_transfer_* gauges, and mirrors it onto
+// vmExport's Progressing condition. It is the single entry point a reconcile
+// loop calls once per pod sync; nothing is published or condition-updated
+// when the exporter pod hasn't reported progress yet.
+func UpdateTransferMetrics(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod, totalVolumes int) {
+	progress := podVolumeTransferProgress(pod)
+	if progress == nil {
+		return
+	}
+	recordTransferMetrics(vmExport.Namespace, vmExport.Name, progress)
+	updateProgressingCondition(vmExport, progress, totalVolumes)
+}
+
+// CleanupTransferMetrics deletes every transfer-metric gauge series published
+// for vmExport. The controller's delete/TTL-expiry handler (defined on the
+// full controller, not part of this checkout) must call this once, the last
+// time it observes vmExport, so a deleted or TTL-expired VirtualMachineExport
+// doesn't leave stale kubevirt_vmexport_transfer_* series behind forever.
+func CleanupTransferMetrics(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod) {
+	progress := podVolumeTransferProgress(pod)
+	if progress == nil {
+		return
+	}
+	deleteTransferMetrics(vmExport.Namespace, vmExport.Name, progress)
+}
+
+// statusVolumeCount returns the number of distinct volumes vmExport is
+// exporting, read from whichever of Status.Links is already populated, for
+// UpdateTransferMetrics's totalVolumes argument. It returns 0 before any
+// link has been built yet, the same way UpdateTransferMetrics already treats
+// "nothing reported yet" as a no-op rather than an error.
+func statusVolumeCount(vmExport *exportv1.VirtualMachineExport) int {
+	if vmExport.Status == nil || vmExport.Status.Links == nil {
+		return 0
+	}
+	if vmExport.Status.Links.Internal != nil {
+		return len(vmExport.Status.Links.Internal.Volumes)
+	}
+	if vmExport.Status.Links.External != nil {
+		return len(vmExport.Status.Links.External.Volumes)
+	}
+	return 0
+}
+
+// podVolumeTransferProgress reads the per-volume/format progress the exporter
+// pod reports through annVolumeBytesTransferred, a JSON array of
+// volumeTransferProgress. It returns nil when the pod hasn't reported
+// progress yet (e.g. it just started) rather than treating a missing or
+// malformed annotation as an error, since UpdateTransferMetrics is called on
+// every reconcile regardless of exporter pod readiness.
+func podVolumeTransferProgress(pod *k8sv1.Pod) []volumeTransferProgress {
+	if pod == nil {
+		return nil
+	}
+	raw, ok := pod.Annotations[annVolumeBytesTransferred]
+	if !ok {
+		return nil
+	}
+	var progress []volumeTransferProgress
+	if err := json.Unmarshal([]byte(raw), &progress); err != nil {
+		return nil
+	}
+	return progress
+}
+
+// updateProgressingCondition mirrors the exporter pod's overall progress onto
+// a human-readable Status.Conditions[type=Progressing] entry, so downstream
+// tooling can watch the VMExport object instead of the exporter's /metrics
+// endpoint or logs.
+func updateProgressingCondition(vmExport *exportv1.VirtualMachineExport, progress []volumeTransferProgress, totalVolumes int) {
+	var totalBytes, transferredBytes int64
+	// progress has one entry per volume *and* format (e.g. raw+gz for a
+	// kubevirt-content volume), so a volume only counts as done once every
+	// format entry reporting for it is done; summing per-entry completions
+	// directly would double-count a volume exported as two formats.
+	volumeComplete := map[string]bool{}
+	for _, p := range progress {
+		totalBytes += p.BytesTotal
+		transferredBytes += p.BytesTransferred
+		done := p.BytesTotal > 0 && p.BytesTransferred >= p.BytesTotal
+		if complete, seen := volumeComplete[p.Volume]; seen {
+			volumeComplete[p.Volume] = complete && done
+		} else {
+			volumeComplete[p.Volume] = done
+		}
+	}
+	completed := 0
+	for _, complete := range volumeComplete {
+		if complete {
+			completed++
+		}
+	}
+	percent := 0
+	if totalBytes > 0 {
+		percent = int(100 * transferredBytes / totalBytes)
+	}
+	message := fmt.Sprintf("%d/%d volumes, %d%% transferred", completed, totalVolumes, percent)
+
+	status := k8sv1.ConditionTrue
+	if completed >= totalVolumes && totalVolumes > 0 {
+		status = k8sv1.ConditionFalse
+	}
+	setExportCondition(vmExport, ConditionProgressing, status, "Transferring", message)
+}
+
+// setExportCondition updates an existing Status.Conditions entry of the given
+// type in place, or appends a new one, mirroring the condition-handling
+// convention used across virt-controller's other reconcilers. Status is
+// initialized if this is called before anything else has populated it, the
+// same nil guard updateTransferStatus applies for the same reason.
+func setExportCondition(vmExport *exportv1.VirtualMachineExport, conditionType exportv1.ConditionType, status k8sv1.ConditionStatus, reason, message string) {
+	if vmExport.Status == nil {
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+	}
+	for i := range vmExport.Status.Conditions {
+		if vmExport.Status.Conditions[i].Type == conditionType {
+			vmExport.Status.Conditions[i].Status = status
+			vmExport.Status.Conditions[i].Reason = reason
+			vmExport.Status.Conditions[i].Message = message
+			return
+		}
+	}
+	vmExport.Status.Conditions = append(vmExport.Status.Conditions, exportv1.Condition{
+		Type:    conditionType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,161 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+var _ = Describe("Transfer progress metrics", func() {
+	It("should report 0 of N volumes complete with no progress yet", func() {
+		vmExport := createPVCVMExport()
+		updateProgressingCondition(vmExport, nil, 5)
+		Expect(vmExport.Status.Conditions).To(HaveLen(1))
+		Expect(vmExport.Status.Conditions[0].Type).To(Equal(ConditionProgressing))
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("0/5 volumes, 0% transferred"))
+	})
+
+	It("should report partial progress across volumes", func() {
+		vmExport := createPVCVMExport()
+		progress := []volumeTransferProgress{
+			{Volume: "disk0", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 100},
+			{Volume: "disk1", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 50},
+		}
+		updateProgressingCondition(vmExport, progress, 5)
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("1/5 volumes, 75% transferred"))
+		Expect(vmExport.Status.Conditions[0].Status).To(Equal(k8sv1.ConditionTrue))
+	})
+
+	It("should mark Progressing false once every volume has completed", func() {
+		vmExport := createPVCVMExport()
+		progress := []volumeTransferProgress{
+			{Volume: "disk0", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 100},
+		}
+		updateProgressingCondition(vmExport, progress, 1)
+		Expect(vmExport.Status.Conditions[0].Status).To(Equal(k8sv1.ConditionFalse))
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("1/1 volumes, 100% transferred"))
+	})
+
+	It("should count a volume exported as two formats as one completed volume, not two", func() {
+		vmExport := createPVCVMExport()
+		progress := []volumeTransferProgress{
+			{Volume: "disk0", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 100},
+			{Volume: "disk0", Format: "kubevirt-gz", BytesTotal: 50, BytesTransferred: 50},
+			{Volume: "disk1", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 100},
+			{Volume: "disk1", Format: "kubevirt-gz", BytesTotal: 50, BytesTransferred: 25},
+		}
+		updateProgressingCondition(vmExport, progress, 2)
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("1/2 volumes, 91% transferred"))
+		Expect(vmExport.Status.Conditions[0].Status).To(Equal(k8sv1.ConditionTrue))
+	})
+
+	It("should not count a volume complete until every one of its formats has completed", func() {
+		vmExport := createPVCVMExport()
+		progress := []volumeTransferProgress{
+			{Volume: "disk0", Format: "kubevirt-raw", BytesTotal: 100, BytesTransferred: 100},
+			{Volume: "disk0", Format: "kubevirt-gz", BytesTotal: 50, BytesTransferred: 49},
+		}
+		updateProgressingCondition(vmExport, progress, 1)
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("0/1 volumes, 99% transferred"))
+		Expect(vmExport.Status.Conditions[0].Status).To(Equal(k8sv1.ConditionTrue))
+	})
+
+	It("should update an existing Progressing condition in place rather than duplicating it", func() {
+		vmExport := createPVCVMExport()
+		updateProgressingCondition(vmExport, nil, 2)
+		updateProgressingCondition(vmExport, []volumeTransferProgress{
+			{Volume: "disk0", Format: "kubevirt-raw", BytesTotal: 10, BytesTransferred: 10},
+		}, 2)
+		Expect(vmExport.Status.Conditions).To(HaveLen(1))
+	})
+
+	It("should not panic when Status hasn't been initialized yet", func() {
+		vmExport := createPVCVMExport()
+		Expect(vmExport.Status).To(BeNil())
+		Expect(func() { updateProgressingCondition(vmExport, nil, 1) }).ToNot(Panic())
+		Expect(vmExport.Status.Conditions).To(HaveLen(1))
+	})
+
+	It("should parse per-volume progress from the pod annotation and skip when absent", func() {
+		vmExport := createPVCVMExport()
+		pod := &k8sv1.Pod{}
+		UpdateTransferMetrics(vmExport, pod, 2)
+		Expect(vmExport.Status).To(BeNil())
+
+		pod.Annotations = map[string]string{
+			annVolumeBytesTransferred: `[{"Volume":"disk0","Format":"kubevirt-raw","BytesTotal":100,"BytesTransferred":50}]`,
+		}
+		UpdateTransferMetrics(vmExport, pod, 2)
+		Expect(vmExport.Status.Conditions[0].Message).To(Equal("0/2 volumes, 50% transferred"))
+	})
+
+	It("should ignore a malformed progress annotation rather than erroring", func() {
+		vmExport := createPVCVMExport()
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			annVolumeBytesTransferred: "not json",
+		}}}
+		UpdateTransferMetrics(vmExport, pod, 2)
+		Expect(vmExport.Status).To(BeNil())
+	})
+
+	It("should report 0 volumes before any Status.Links have been populated", func() {
+		vmExport := createPVCVMExport()
+		Expect(statusVolumeCount(vmExport)).To(Equal(0))
+	})
+
+	It("should count volumes from whichever of Status.Links is populated", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{
+			Links: &exportv1.VirtualMachineExportLinks{
+				Internal: &exportv1.VirtualMachineExportLink{
+					Volumes: []exportv1.VirtualMachineExportVolume{{Name: "disk0"}, {Name: "disk1"}},
+				},
+			},
+		}
+		Expect(statusVolumeCount(vmExport)).To(Equal(2))
+	})
+
+	It("should not panic cleaning up metrics for a pod that never reported progress", func() {
+		vmExport := createPVCVMExport()
+		Expect(func() { CleanupTransferMetrics(vmExport, &k8sv1.Pod{}) }).ToNot(Panic())
+	})
+
+	It("should delete every gauge series a pod had reported progress for", func() {
+		vmExport := createPVCVMExport()
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			annVolumeBytesTransferred: `[{"Volume":"disk0","Format":"kubevirt-raw","BytesTotal":100,"BytesTransferred":50}]`,
+		}}}
+		recordTransferMetrics(vmExport.Namespace, vmExport.Name, podVolumeTransferProgress(pod))
+		labels := prometheus.Labels{"namespace": vmExport.Namespace, "name": vmExport.Name, "volume": "disk0", "format": "kubevirt-raw"}
+		Expect(transferBytesTotal.Delete(labels)).To(BeTrue())
+		recordTransferMetrics(vmExport.Namespace, vmExport.Name, podVolumeTransferProgress(pod))
+
+		CleanupTransferMetrics(vmExport, pod)
+		Expect(transferBytesTotal.Delete(labels)).To(BeFalse())
+	})
+})
@@ -0,0 +1,200 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	k8sv1 "k8s.io/api/core/v1"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+// annObjectStorageProgress carries the per-volume bytesWritten/bytesTotal
+// counters the exporter pod reports back as it streams each volume's formats
+// to the configured bucket, keyed by volume name, the same way
+// annVolumeBytesTransferred reports progress for the Service/Ingress path.
+const annObjectStorageProgress = "kubevirt.io/export-object-storage-progress"
+
+const (
+	// objectStorageCredentialsVolumeName is the name of the volume that mounts the
+	// access/secret key (and optional CA bundle) Secret referenced by
+	// spec.destination.objectStorage.secretRef into the exporter pod.
+	objectStorageCredentialsVolumeName = "object-storage-credentials"
+	objectStorageCredentialsMountPath  = "/var/run/kubevirt-export/object-storage"
+
+	// annObjectStorageParams carries the serialized destination parameters on the
+	// exporter pod, mirroring how annCertParams carries the cert rotation params.
+	annObjectStorageParams = "kubevirt.io/export-object-storage-params"
+)
+
+// ObjectStorageParams is the set of object-storage upload parameters the exporter
+// pod needs, serialized onto annObjectStorageParams the same way CertParams is
+// serialized onto annCertParams.
+type ObjectStorageParams struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+}
+
+func serializeObjectStorageParams(params *ObjectStorageParams) (string, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// addObjectStorageDestination wires the credentials Secret named by
+// vmExport.Spec.Destination.ObjectStorage.SecretRef into pod, and stamps the
+// upload parameters onto the pod so virt-exportserver can stream each volume's
+// formats to the configured bucket instead of (or in addition to) serving them
+// over the export Service. It is a no-op when no object storage destination is
+// configured.
+func (ctrl *VMExportController) addObjectStorageDestination(pod *k8sv1.Pod, vmExport *exportv1.VirtualMachineExport) error {
+	dest := vmExport.Spec.Destination
+	if dest == nil || dest.ObjectStorage == nil {
+		return nil
+	}
+	objectStorage := dest.ObjectStorage
+
+	params := &ObjectStorageParams{
+		Endpoint: objectStorage.Endpoint,
+		Region:   objectStorage.Region,
+		Bucket:   objectStorage.Bucket,
+		Prefix:   objectStorage.Prefix,
+	}
+	serialized, err := serializeObjectStorageParams(params)
+	if err != nil {
+		return err
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[annObjectStorageParams] = serialized
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, k8sv1.Volume{
+		Name: objectStorageCredentialsVolumeName,
+		VolumeSource: k8sv1.VolumeSource{
+			Secret: &k8sv1.SecretVolumeSource{
+				SecretName: objectStorage.SecretRef.Name,
+			},
+		},
+	})
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts, k8sv1.VolumeMount{
+			Name:      objectStorageCredentialsVolumeName,
+			MountPath: objectStorageCredentialsMountPath,
+			ReadOnly:  true,
+		})
+		pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env,
+			k8sv1.EnvVar{Name: "OBJECT_STORAGE_ENDPOINT", Value: objectStorage.Endpoint},
+			k8sv1.EnvVar{Name: "OBJECT_STORAGE_REGION", Value: objectStorage.Region},
+			k8sv1.EnvVar{Name: "OBJECT_STORAGE_BUCKET", Value: objectStorage.Bucket},
+			k8sv1.EnvVar{Name: "OBJECT_STORAGE_PREFIX", Value: objectStorage.Prefix},
+			k8sv1.EnvVar{Name: "OBJECT_STORAGE_CREDENTIALS_DIR", Value: objectStorageCredentialsMountPath},
+		)
+	}
+	return nil
+}
+
+// updateObjectStorageStatus mirrors the per-volume upload progress the exporter
+// pod reports back onto vmExport.Status.ObjectStorage, so virtctl and other
+// clients can discover the final object URIs without needing a route, ingress,
+// or Service at all.
+func (ctrl *VMExportController) updateObjectStorageStatus(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod) {
+	dest := vmExport.Spec.Destination
+	if dest == nil || dest.ObjectStorage == nil || pod == nil {
+		return
+	}
+	objectStorage := dest.ObjectStorage
+
+	if vmExport.Status == nil {
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+	}
+	if vmExport.Status.ObjectStorage == nil {
+		vmExport.Status.ObjectStorage = &exportv1.VirtualMachineExportObjectStorageStatus{}
+	}
+	reported := podObjectStorageProgress(pod)
+	volumeNames := make([]string, 0, len(reported))
+	for volumeName := range reported {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	sort.Strings(volumeNames)
+
+	prefix := objectStoragePrefix(objectStorage.Prefix)
+	status := vmExport.Status.ObjectStorage
+	status.Volumes = make([]exportv1.VirtualMachineExportObjectStorageVolumeStatus, 0, len(volumeNames))
+	for _, volumeName := range volumeNames {
+		progress := reported[volumeName]
+		status.Volumes = append(status.Volumes, exportv1.VirtualMachineExportObjectStorageVolumeStatus{
+			Name:           volumeName,
+			BytesWritten:   progress.BytesWritten,
+			BytesTotal:     progress.BytesTotal,
+			ObjectURI:      fmt.Sprintf("s3://%s/%s%s", objectStorage.Bucket, prefix, volumeName),
+			ManifestObject: fmt.Sprintf("s3://%s/%smanifest.json", objectStorage.Bucket, prefix),
+		})
+	}
+}
+
+// objectStoragePrefix normalizes prefix so it always joins onto the object
+// key with exactly one "/", whether or not the user supplied one in
+// Spec.Destination.ObjectStorage.Prefix. Without this, a prefix of "exports"
+// (no trailing slash) would concatenate directly onto the volume name as
+// "exportsdisk0" instead of "exports/disk0".
+func objectStoragePrefix(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
+
+// objectStorageVolumeProgress mirrors the JSON object the exporter pod writes
+// to annObjectStorageProgress for a single volume. Its fields are exported so
+// encoding/json can populate them from that annotation.
+type objectStorageVolumeProgress struct {
+	BytesWritten int64 `json:"bytesWritten"`
+	BytesTotal   int64 `json:"bytesTotal"`
+}
+
+// podObjectStorageProgress reads the upload progress the exporter pod reports
+// through annObjectStorageProgress, a JSON object mapping volume name to
+// {bytesWritten,bytesTotal}. It returns an empty map when the pod hasn't
+// reported progress yet (e.g. it just started) rather than treating a missing
+// or malformed annotation as an error, since updateObjectStorageStatus is
+// called on every reconcile regardless of exporter pod readiness.
+func podObjectStorageProgress(pod *k8sv1.Pod) map[string]objectStorageVolumeProgress {
+	if pod == nil {
+		return map[string]objectStorageVolumeProgress{}
+	}
+	raw, ok := pod.Annotations[annObjectStorageProgress]
+	if !ok {
+		return map[string]objectStorageVolumeProgress{}
+	}
+	var reported map[string]objectStorageVolumeProgress
+	if err := json.Unmarshal([]byte(raw), &reported); err != nil {
+		return map[string]objectStorageVolumeProgress{}
+	}
+	return reported
+}
@@ -0,0 +1,138 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	k8sv1 "k8s.io/api/core/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+var _ = Describe("Object storage destination", func() {
+	var controller *VMExportController
+
+	BeforeEach(func() {
+		controller = &VMExportController{}
+	})
+
+	newPod := func() *k8sv1.Pod {
+		return &k8sv1.Pod{
+			Spec: k8sv1.PodSpec{
+				Containers: []k8sv1.Container{{Name: "exportserver"}},
+			},
+		}
+	}
+
+	It("should do nothing when no object storage destination is configured", func() {
+		pod := newPod()
+		vmExport := createPVCVMExport()
+		Expect(controller.addObjectStorageDestination(pod, vmExport)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(BeEmpty())
+		Expect(pod.Spec.Containers[0].Env).To(BeEmpty())
+	})
+
+	It("should mount credentials and set env vars when an object storage destination is configured", func() {
+		pod := newPod()
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Destination = &exportv1.VirtualMachineExportDestination{
+			ObjectStorage: &exportv1.ObjectStorageDestination{
+				Endpoint: "https://s3.example.com",
+				Region:   "us-east-1",
+				Bucket:   "my-bucket",
+				Prefix:   "exports/test/",
+				SecretRef: k8sv1.LocalObjectReference{
+					Name: "my-bucket-creds",
+				},
+			},
+		}
+
+		Expect(controller.addObjectStorageDestination(pod, vmExport)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(ContainElement(k8sv1.Volume{
+			Name: objectStorageCredentialsVolumeName,
+			VolumeSource: k8sv1.VolumeSource{
+				Secret: &k8sv1.SecretVolumeSource{
+					SecretName: "my-bucket-creds",
+				},
+			},
+		}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(ContainElement(k8sv1.VolumeMount{
+			Name:      objectStorageCredentialsVolumeName,
+			MountPath: objectStorageCredentialsMountPath,
+			ReadOnly:  true,
+		}))
+		Expect(pod.Annotations[annObjectStorageParams]).To(ContainSubstring("my-bucket"))
+	})
+
+	It("should report zero volumes when the exporter pod hasn't reported progress yet", func() {
+		pod := newPod()
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Destination = &exportv1.VirtualMachineExportDestination{
+			ObjectStorage: &exportv1.ObjectStorageDestination{Bucket: "my-bucket"},
+		}
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+
+		controller.updateObjectStorageStatus(vmExport, pod)
+		Expect(vmExport.Status.ObjectStorage).ToNot(BeNil())
+		Expect(vmExport.Status.ObjectStorage.Volumes).To(BeEmpty())
+	})
+
+	It("should surface per-volume progress reported on the exporter pod annotation", func() {
+		pod := newPod()
+		pod.Annotations = map[string]string{
+			annObjectStorageProgress: `{"disk0":{"bytesWritten":512,"bytesTotal":1024}}`,
+		}
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Destination = &exportv1.VirtualMachineExportDestination{
+			ObjectStorage: &exportv1.ObjectStorageDestination{Bucket: "my-bucket", Prefix: "exports/"},
+		}
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+
+		controller.updateObjectStorageStatus(vmExport, pod)
+		Expect(vmExport.Status.ObjectStorage.Volumes).To(ConsistOf(exportv1.VirtualMachineExportObjectStorageVolumeStatus{
+			Name:           "disk0",
+			BytesWritten:   512,
+			BytesTotal:     1024,
+			ObjectURI:      "s3://my-bucket/exports/disk0",
+			ManifestObject: "s3://my-bucket/exports/manifest.json",
+		}))
+	})
+
+	It("should report multi-volume progress in a stable, name-sorted order every reconcile", func() {
+		pod := newPod()
+		pod.Annotations = map[string]string{
+			annObjectStorageProgress: `{"disk1":{"bytesWritten":10,"bytesTotal":10},"disk0":{"bytesWritten":5,"bytesTotal":10}}`,
+		}
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Destination = &exportv1.VirtualMachineExportDestination{
+			ObjectStorage: &exportv1.ObjectStorageDestination{Bucket: "my-bucket"},
+		}
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+
+		for i := 0; i < 5; i++ {
+			controller.updateObjectStorageStatus(vmExport, pod)
+			Expect(vmExport.Status.ObjectStorage.Volumes).To(HaveLen(2))
+			Expect(vmExport.Status.ObjectStorage.Volumes[0].Name).To(Equal("disk0"))
+			Expect(vmExport.Status.ObjectStorage.Volumes[1].Name).To(Equal("disk1"))
+		}
+	})
+})
@@ -0,0 +1,106 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"context"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	virtv1 "kubevirt.io/api/core/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+// decorateExporterPod applies the pod-mutating helpers that createExporterPod
+// (defined on the full controller, not part of this checkout) must call once
+// it has built pod's base container/volume spec, the same way it already has
+// to call the cert/token env helpers for the Service/Ingress path. Keeping
+// this as its own method, rather than inlining each helper's call site
+// directly into createExporterPod, means every such helper gets a single,
+// real in-package caller regardless of which pod-build entry point ends up
+// invoking it.
+func (ctrl *VMExportController) decorateExporterPod(pod *k8sv1.Pod, vmExport *exportv1.VirtualMachineExport, kv *virtv1.KubeVirt) error {
+	if cancelled, err := ctrl.reconcileCancellationForExport(vmExport, pod); err != nil || cancelled {
+		return err
+	}
+	if err := ctrl.addObjectStorageDestination(pod, vmExport); err != nil {
+		return err
+	}
+	ctrl.addTransferPolicyEnv(pod, vmExport, kv)
+	return nil
+}
+
+// updateExportStatus applies the Status-mutating helpers that updateVMExport
+// (defined on the full controller, not part of this checkout) must call once
+// it has resolved the exporter pod for vmExport, mirroring decorateExporterPod
+// on the read side.
+func (ctrl *VMExportController) updateExportStatus(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod, kv *virtv1.KubeVirt) {
+	ctrl.updateObjectStorageStatus(vmExport, pod)
+	ctrl.updateTransferStatus(vmExport, pod, kv)
+	UpdateTransferMetrics(vmExport, pod, statusVolumeCount(vmExport))
+}
+
+// presignStatusLinks mints/renews presignedUrl+expiresAt on every format
+// already populated on Status.Links, when vmExport opted into Spec.Presign,
+// and reports how long until updateVMExport must requeue to refresh them
+// again before they expire. It is a no-op, returning 0, when vmExport didn't
+// opt into presigning or has no token secret or links yet; it also returns 0
+// when no format was minted. A returned 0 therefore does not distinguish "no
+// refresh due" from presignRequeueAfter's "requeue immediately".
+func (ctrl *VMExportController) presignStatusLinks(vmExport *exportv1.VirtualMachineExport, now time.Time) (time.Duration, error) {
+	if !shouldPresign(vmExport) {
+		return 0, nil
+	}
+	if vmExport.Status == nil || vmExport.Status.TokenSecretRef == nil || vmExport.Status.Links == nil {
+		return 0, nil
+	}
+
+	namespace := vmExport.Namespace
+	key, err := ctrl.getOrCreatePresignKey(vmExport,
+		func(name string) (*k8sv1.Secret, error) {
+			return ctrl.Client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		},
+		func(secret *k8sv1.Secret) error {
+			_, err := ctrl.Client.CoreV1().Secrets(namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+			return err
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	ttl := presignTTL(vmExport)
+	presignLinkVolumes := func(link *exportv1.VirtualMachineExportLink) {
+		if link == nil {
+			return
+		}
+		for i := range link.Volumes {
+			for j := range link.Volumes[i].Formats {
+				addPresignedURL(&link.Volumes[i].Formats[j], key, namespace, vmExport.Name, link.Volumes[i].Name, now, ttl)
+			}
+		}
+	}
+	presignLinkVolumes(vmExport.Status.Links.Internal)
+	presignLinkVolumes(vmExport.Status.Links.External)
+
+	return presignRequeueAfter(vmExport, now), nil
+}
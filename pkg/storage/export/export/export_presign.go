@@ -0,0 +1,183 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+// presignKeyLength is the size, in bytes, of a freshly generated HMAC signing
+// key, matching the sha256 output size presignSignature hashes with.
+const presignKeyLength = 32
+
+const (
+	// defaultPresignTTL is used when spec.presign.ttlDuration is unset.
+	defaultPresignTTL = 5 * time.Minute
+
+	// presignKeyName is the key under which the export-scoped HMAC signing key
+	// is stored in the same Secret referenced by Status.TokenSecretRef.
+	presignKeyName = "presign-key"
+)
+
+// presignSignature computes the HMAC-SHA256 signature, base64url encoded, used
+// to authenticate a pre-signed volume download without an Authorization header.
+// It signs the export namespace/name, volume name and format, and the expiry,
+// so that a leaked URL cannot be replayed against a different volume or past
+// its expiresAt.
+func presignSignature(key []byte, namespace, name, volume, format string, expiresAt time.Time) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s/%s/%s/%s/%d", namespace, name, volume, format, expiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shouldPresign reports whether the VMExport opted into pre-signed links.
+func shouldPresign(vmExport *exportv1.VirtualMachineExport) bool {
+	return vmExport.Spec.Presign != nil
+}
+
+// presignTTL returns the effective, user-configurable TTL for pre-signed URLs,
+// defaulting to defaultPresignTTL.
+func presignTTL(vmExport *exportv1.VirtualMachineExport) time.Duration {
+	if vmExport.Spec.Presign == nil || vmExport.Spec.Presign.TTLDuration == nil {
+		return defaultPresignTTL
+	}
+	return vmExport.Spec.Presign.TTLDuration.Duration
+}
+
+// addPresignedURL sets url's matching exportv1.VirtualMachineExportVolumeFormat
+// presignedUrl/expiresAt fields in place, using key as the export-scoped signing
+// key read from the Status.TokenSecretRef Secret.
+func addPresignedURL(format *exportv1.VirtualMachineExportVolumeFormat, key []byte, namespace, name, volume string, now time.Time, ttl time.Duration) {
+	expiresAt := now.Add(ttl)
+	sig := presignSignature(key, namespace, name, volume, string(format.Format), expiresAt)
+	format.PresignedUrl = fmt.Sprintf("%s?expires=%d&sig=%s", format.Url, expiresAt.Unix(), sig)
+	format.ExpiresAt = &metav1.Time{Time: expiresAt}
+}
+
+// presignRequeueAfter returns how long until the controller should requeue to
+// renew pre-signed URLs before they expire, refreshing at 80% of the TTL so
+// slow clients still have time to retry with the fresh link. It anchors that
+// 80% point to the expiresAt the last addPresignedURL call actually minted
+// (the earliest one still on Status.Links, since every format shares the same
+// TTL but is refreshed together), not to CreationTimestamp: URLs are minted at
+// reconcile time with now.Add(ttl), so anchoring to creation instead would
+// only be correct for the very first TTL window and would requeue every
+// reconcile forever after it elapsed. now is the current time the remaining
+// duration is computed against; a TTL window that has already elapsed (e.g. a
+// stalled reconcile loop, or no URL minted yet) returns 0 so the caller
+// requeues immediately rather than waiting a further 80% of the TTL.
+func presignRequeueAfter(vmExport *exportv1.VirtualMachineExport, now time.Time) time.Duration {
+	ttl := presignTTL(vmExport)
+	expiresAt, ok := earliestPresignExpiry(vmExport)
+	if !ok {
+		return 0
+	}
+	refreshAt := expiresAt.Add(-time.Duration(float64(ttl) * 0.2))
+	if remaining := refreshAt.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// earliestPresignExpiry returns the soonest ExpiresAt across every minted
+// format on Status.Links, so a reconcile that's behind on refreshing some
+// volumes/formats but not others still requeues for the one closest to
+// expiring rather than the one furthest out.
+func earliestPresignExpiry(vmExport *exportv1.VirtualMachineExport) (time.Time, bool) {
+	if vmExport.Status == nil || vmExport.Status.Links == nil {
+		return time.Time{}, false
+	}
+
+	var earliest time.Time
+	found := false
+	visit := func(link *exportv1.VirtualMachineExportLink) {
+		if link == nil {
+			return
+		}
+		for _, volume := range link.Volumes {
+			for _, format := range volume.Formats {
+				if format.ExpiresAt == nil {
+					continue
+				}
+				if !found || format.ExpiresAt.Time.Before(earliest) {
+					earliest = format.ExpiresAt.Time
+					found = true
+				}
+			}
+		}
+	}
+	visit(vmExport.Status.Links.Internal)
+	visit(vmExport.Status.Links.External)
+	return earliest, found
+}
+
+// generatePresignKey returns a new random HMAC signing key suitable for
+// presignSignature.
+func generatePresignKey() ([]byte, error) {
+	key := make([]byte, presignKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// getOrCreatePresignKey fetches the export-scoped HMAC key from the token
+// Secret named by vmExport.Status.TokenSecretRef, generating and persisting one
+// via updateSecret if it is not yet present. It is stored alongside the bearer
+// token the same secret already carries.
+func (ctrl *VMExportController) getOrCreatePresignKey(
+	vmExport *exportv1.VirtualMachineExport,
+	secretClient func(name string) (*k8sv1.Secret, error),
+	updateSecret func(*k8sv1.Secret) error,
+) ([]byte, error) {
+	if vmExport.Status == nil || vmExport.Status.TokenSecretRef == nil {
+		return nil, fmt.Errorf("cannot presign without a token secret")
+	}
+	secret, err := secretClient(*vmExport.Status.TokenSecretRef)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := secret.Data[presignKeyName]; ok && len(key) > 0 {
+		return key, nil
+	}
+
+	key, err := generatePresignKey()
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[presignKeyName] = key
+	if err := updateSecret(secret); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,182 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+var _ = Describe("Pre-signed download URLs", func() {
+	It("should not presign when spec.presign is unset", func() {
+		vmExport := createPVCVMExport()
+		Expect(shouldPresign(vmExport)).To(BeFalse())
+		Expect(presignTTL(vmExport)).To(Equal(defaultPresignTTL))
+	})
+
+	It("should use the configured TTL when spec.presign.ttlDuration is set", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Presign = &exportv1.VirtualMachineExportPresign{
+			TTLDuration: &metav1.Duration{Duration: 2 * time.Minute},
+		}
+		Expect(shouldPresign(vmExport)).To(BeTrue())
+		Expect(presignTTL(vmExport)).To(Equal(2 * time.Minute))
+	})
+
+	It("should produce a stable, verifiable signature for the same inputs", func() {
+		key := []byte("super-secret-export-key")
+		expiresAt := time.Now().Add(time.Minute)
+		sig1 := presignSignature(key, "default", "test", "disk0", "kubevirt-raw", expiresAt)
+		sig2 := presignSignature(key, "default", "test", "disk0", "kubevirt-raw", expiresAt)
+		Expect(sig1).To(Equal(sig2))
+		Expect(sig1).ToNot(BeEmpty())
+	})
+
+	It("should produce a different signature for a different volume", func() {
+		key := []byte("super-secret-export-key")
+		expiresAt := time.Now().Add(time.Minute)
+		sig1 := presignSignature(key, "default", "test", "disk0", "kubevirt-raw", expiresAt)
+		sig2 := presignSignature(key, "default", "test", "disk1", "kubevirt-raw", expiresAt)
+		Expect(sig1).ToNot(Equal(sig2))
+	})
+
+	It("should populate presignedUrl and expiresAt on the volume format", func() {
+		format := &exportv1.VirtualMachineExportVolumeFormat{
+			Format: exportv1.KubeVirtRaw,
+			Url:    "https://virt-export-test.default.svc/volumes/disk0/disk.img",
+		}
+		now := time.Now()
+		addPresignedURL(format, []byte("key"), "default", "test", "disk0", now, time.Minute)
+		Expect(format.PresignedUrl).To(ContainSubstring(format.Url))
+		Expect(format.PresignedUrl).To(ContainSubstring("sig="))
+		Expect(format.ExpiresAt).ToNot(BeNil())
+		Expect(format.ExpiresAt.Time).To(BeTemporally("~", now.Add(time.Minute), time.Second))
+	})
+
+	It("should requeue immediately when no pre-signed URL has been minted yet", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Presign = &exportv1.VirtualMachineExportPresign{
+			TTLDuration: &metav1.Duration{Duration: time.Minute},
+		}
+		Expect(presignRequeueAfter(vmExport, time.Now())).To(BeZero())
+	})
+
+	It("should requeue immediately once the refresh point has already passed", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Presign = &exportv1.VirtualMachineExportPresign{
+			TTLDuration: &metav1.Duration{Duration: time.Minute},
+		}
+		withPresignExpiry(vmExport, time.Now().Add(5*time.Second))
+		Expect(presignRequeueAfter(vmExport, time.Now())).To(BeZero())
+	})
+
+	It("should requeue before the TTL elapses when the refresh point is still ahead", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.Presign = &exportv1.VirtualMachineExportPresign{
+			TTLDuration: &metav1.Duration{Duration: time.Minute},
+		}
+		withPresignExpiry(vmExport, time.Now().Add(time.Minute))
+		requeue := presignRequeueAfter(vmExport, time.Now())
+		Expect(requeue).To(BeNumerically(">", 0))
+		Expect(requeue).To(BeNumerically("<=", 48*time.Second))
+	})
+
+	It("should keep requeuing correctly into a second TTL window instead of hot-looping at 0 forever", func() {
+		vmExport := createPVCVMExport()
+		vmExport.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-time.Hour)))
+		vmExport.Spec.Presign = &exportv1.VirtualMachineExportPresign{
+			TTLDuration: &metav1.Duration{Duration: time.Minute},
+		}
+		// CreationTimestamp is long past creation+0.8*ttl, but the URL was just
+		// re-minted this reconcile with now.Add(ttl): the requeue must anchor to
+		// that expiry, not to CreationTimestamp, or it would wrongly return 0.
+		withPresignExpiry(vmExport, time.Now().Add(time.Minute))
+		requeue := presignRequeueAfter(vmExport, time.Now())
+		Expect(requeue).To(BeNumerically(">", 0))
+		Expect(requeue).To(BeNumerically("<=", 48*time.Second))
+	})
+
+	Describe("getOrCreatePresignKey", func() {
+		var controller *VMExportController
+
+		BeforeEach(func() {
+			controller = &VMExportController{}
+		})
+
+		It("should generate and persist a key when the secret doesn't have one yet", func() {
+			vmExport := createPVCVMExport()
+			vmExport.Status = &exportv1.VirtualMachineExportStatus{TokenSecretRef: pointer.StringPtr("export-token")}
+			secret := &k8sv1.Secret{}
+			var persisted *k8sv1.Secret
+
+			key, err := controller.getOrCreatePresignKey(vmExport,
+				func(name string) (*k8sv1.Secret, error) { return secret, nil },
+				func(s *k8sv1.Secret) error { persisted = s; return nil },
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key).To(HaveLen(presignKeyLength))
+			Expect(persisted).ToNot(BeNil())
+			Expect(persisted.Data[presignKeyName]).To(Equal(key))
+		})
+
+		It("should reuse the existing key without calling updateSecret again", func() {
+			vmExport := createPVCVMExport()
+			vmExport.Status = &exportv1.VirtualMachineExportStatus{TokenSecretRef: pointer.StringPtr("export-token")}
+			existingKey := []byte("already-there-already-there-1234")
+			secret := &k8sv1.Secret{Data: map[string][]byte{presignKeyName: existingKey}}
+
+			key, err := controller.getOrCreatePresignKey(vmExport,
+				func(name string) (*k8sv1.Secret, error) { return secret, nil },
+				func(s *k8sv1.Secret) error { return fmt.Errorf("should not be called") },
+			)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key).To(Equal(existingKey))
+		})
+	})
+})
+
+// withPresignExpiry stamps a single minted format's ExpiresAt onto
+// vmExport.Status.Links.Internal, the shape earliestPresignExpiry reads, so
+// tests can exercise presignRequeueAfter without going through
+// addPresignedURL's HMAC signing.
+func withPresignExpiry(vmExport *exportv1.VirtualMachineExport, expiresAt time.Time) {
+	vmExport.Status = &exportv1.VirtualMachineExportStatus{
+		Links: &exportv1.VirtualMachineExportLinks{
+			Internal: &exportv1.VirtualMachineExportLink{
+				Volumes: []exportv1.VirtualMachineExportVolume{
+					{
+						Name: "disk0",
+						Formats: []exportv1.VirtualMachineExportVolumeFormat{
+							{Format: exportv1.KubeVirtRaw, ExpiresAt: &metav1.Time{Time: expiresAt}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"strconv"
+
+	k8sv1 "k8s.io/api/core/v1"
+
+	virtv1 "kubevirt.io/api/core/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	envMaxBandwidthBytesPerSecond = "MAX_BANDWIDTH_BYTES_PER_SECOND"
+	envMaxConcurrentDownloads     = "MAX_CONCURRENT_DOWNLOADS"
+
+	// defaultMaxConcurrentDownloads is used when neither the VMExport nor the
+	// cluster-wide KubeVirt CR default is set.
+	defaultMaxConcurrentDownloads = 2
+
+	// annInFlightDownloads carries the exporter pod's current count of
+	// connections admitted past its MAX_CONCURRENT_DOWNLOADS semaphore, the
+	// same way annObjectStorageProgress reports object storage upload
+	// progress back onto the pod.
+	annInFlightDownloads = "kubevirt.io/export-in-flight-downloads"
+)
+
+// effectiveTransferPolicy resolves the bandwidth/concurrency limits to apply to
+// an export, preferring the per-export spec.transferPolicy over the
+// cluster-wide default carried on the KubeVirt CR, and finally
+// defaultMaxConcurrentDownloads when nothing is configured.
+func effectiveTransferPolicy(vmExport *exportv1.VirtualMachineExport, kv *virtv1.KubeVirt) (maxBandwidthBytesPerSecond int64, maxConcurrentDownloads int32) {
+	if kv != nil {
+		if clusterDefault := kv.Spec.Configuration.VMExportConfiguration; clusterDefault != nil {
+			if clusterDefault.DefaultTransferPolicy != nil {
+				maxBandwidthBytesPerSecond = clusterDefault.DefaultTransferPolicy.MaxBandwidthBytesPerSecond
+				maxConcurrentDownloads = clusterDefault.DefaultTransferPolicy.MaxConcurrentDownloads
+			}
+		}
+	}
+	if maxConcurrentDownloads == 0 {
+		maxConcurrentDownloads = defaultMaxConcurrentDownloads
+	}
+
+	policy := vmExport.Spec.TransferPolicy
+	if policy == nil {
+		return maxBandwidthBytesPerSecond, maxConcurrentDownloads
+	}
+	if policy.MaxBandwidthBytesPerSecond > 0 {
+		maxBandwidthBytesPerSecond = policy.MaxBandwidthBytesPerSecond
+	}
+	if policy.MaxConcurrentDownloads > 0 {
+		maxConcurrentDownloads = policy.MaxConcurrentDownloads
+	}
+	return maxBandwidthBytesPerSecond, maxConcurrentDownloads
+}
+
+// addTransferPolicyEnv translates the effective transfer policy into the env
+// vars virt-exportserver reads to drive its per-connection token-bucket
+// limiter and its 429-with-Retry-After concurrency semaphore. It is a method
+// on VMExportController, mirroring addObjectStorageDestination, so the
+// reconcile loop's createExporterPod can call every pod-mutating helper the
+// same way.
+func (ctrl *VMExportController) addTransferPolicyEnv(pod *k8sv1.Pod, vmExport *exportv1.VirtualMachineExport, kv *virtv1.KubeVirt) {
+	maxBandwidth, maxConcurrent := effectiveTransferPolicy(vmExport, kv)
+	env := []k8sv1.EnvVar{
+		{Name: envMaxConcurrentDownloads, Value: strconv.FormatInt(int64(maxConcurrent), 10)},
+	}
+	if maxBandwidth > 0 {
+		env = append(env, k8sv1.EnvVar{Name: envMaxBandwidthBytesPerSecond, Value: strconv.FormatInt(maxBandwidth, 10)})
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, env...)
+	}
+}
+
+// podInFlightDownloads reads the exporter pod's current concurrency-semaphore
+// occupancy from annInFlightDownloads, the same way podObjectStorageProgress
+// reads upload progress. A missing or malformed annotation (e.g. the pod
+// hasn't started serving yet) reports zero in-flight downloads rather than an
+// error, since updateTransferStatus runs on every reconcile regardless of
+// exporter pod readiness.
+func podInFlightDownloads(pod *k8sv1.Pod) int32 {
+	if pod == nil {
+		return 0
+	}
+	raw, ok := pod.Annotations[annInFlightDownloads]
+	if !ok {
+		return 0
+	}
+	count, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil || count < 0 {
+		return 0
+	}
+	return int32(count)
+}
+
+// updateTransferStatus surfaces the effective transfer policy and the
+// in-flight download count reported by the exporter pod on Status.Transfer.
+// Status is initialized if this is called before anything else has populated
+// it.
+func (ctrl *VMExportController) updateTransferStatus(vmExport *exportv1.VirtualMachineExport, pod *k8sv1.Pod, kv *virtv1.KubeVirt) {
+	maxBandwidth, maxConcurrent := effectiveTransferPolicy(vmExport, kv)
+	if vmExport.Status == nil {
+		vmExport.Status = &exportv1.VirtualMachineExportStatus{}
+	}
+	vmExport.Status.Transfer = &exportv1.VirtualMachineExportTransferStatus{
+		MaxBandwidthBytesPerSecond: maxBandwidth,
+		MaxConcurrentDownloads:     maxConcurrent,
+		InFlightDownloads:          podInFlightDownloads(pod),
+	}
+}
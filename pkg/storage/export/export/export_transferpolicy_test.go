@@ -0,0 +1,120 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	k8sv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	virtv1 "kubevirt.io/api/core/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+var _ = Describe("Transfer policy", func() {
+	It("should default to defaultMaxConcurrentDownloads with no bandwidth limit", func() {
+		vmExport := createPVCVMExport()
+		maxBandwidth, maxConcurrent := effectiveTransferPolicy(vmExport, nil)
+		Expect(maxBandwidth).To(BeZero())
+		Expect(maxConcurrent).To(BeEquivalentTo(defaultMaxConcurrentDownloads))
+	})
+
+	It("should use the cluster-wide default from the KubeVirt CR", func() {
+		vmExport := createPVCVMExport()
+		kv := &virtv1.KubeVirt{
+			Spec: virtv1.KubeVirtSpec{
+				Configuration: virtv1.KubeVirtConfiguration{
+					VMExportConfiguration: &virtv1.VMExportConfiguration{
+						DefaultTransferPolicy: &exportv1.VirtualMachineExportTransferPolicy{
+							MaxBandwidthBytesPerSecond: 1024,
+							MaxConcurrentDownloads:     4,
+						},
+					},
+				},
+			},
+		}
+		maxBandwidth, maxConcurrent := effectiveTransferPolicy(vmExport, kv)
+		Expect(maxBandwidth).To(BeEquivalentTo(1024))
+		Expect(maxConcurrent).To(BeEquivalentTo(4))
+	})
+
+	It("should let the per-export policy override the cluster default", func() {
+		vmExport := createPVCVMExport()
+		vmExport.Spec.TransferPolicy = &exportv1.VirtualMachineExportTransferPolicy{
+			MaxBandwidthBytesPerSecond: 2048,
+		}
+		kv := &virtv1.KubeVirt{
+			Spec: virtv1.KubeVirtSpec{
+				Configuration: virtv1.KubeVirtConfiguration{
+					VMExportConfiguration: &virtv1.VMExportConfiguration{
+						DefaultTransferPolicy: &exportv1.VirtualMachineExportTransferPolicy{
+							MaxBandwidthBytesPerSecond: 1024,
+							MaxConcurrentDownloads:     4,
+						},
+					},
+				},
+			},
+		}
+		maxBandwidth, maxConcurrent := effectiveTransferPolicy(vmExport, kv)
+		Expect(maxBandwidth).To(BeEquivalentTo(2048))
+		Expect(maxConcurrent).To(BeEquivalentTo(4))
+	})
+
+	It("should set the env vars on every exporter container", func() {
+		pod := &k8sv1.Pod{Spec: k8sv1.PodSpec{Containers: []k8sv1.Container{{Name: "exportserver"}}}}
+		vmExport := createPVCVMExport()
+		vmExport.Spec.TransferPolicy = &exportv1.VirtualMachineExportTransferPolicy{
+			MaxBandwidthBytesPerSecond: 2048,
+			MaxConcurrentDownloads:     3,
+		}
+		controller := &VMExportController{}
+		controller.addTransferPolicyEnv(pod, vmExport, nil)
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(k8sv1.EnvVar{Name: envMaxBandwidthBytesPerSecond, Value: "2048"}))
+		Expect(pod.Spec.Containers[0].Env).To(ContainElement(k8sv1.EnvVar{Name: envMaxConcurrentDownloads, Value: "3"}))
+	})
+
+	It("should initialize Status when updating transfer status before it's been set", func() {
+		vmExport := createPVCVMExport()
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annInFlightDownloads: "1"}}}
+		Expect(vmExport.Status).To(BeNil())
+		controller := &VMExportController{}
+		controller.updateTransferStatus(vmExport, pod, nil)
+		Expect(vmExport.Status).ToNot(BeNil())
+		Expect(vmExport.Status.Transfer.MaxConcurrentDownloads).To(BeEquivalentTo(defaultMaxConcurrentDownloads))
+		Expect(vmExport.Status.Transfer.InFlightDownloads).To(BeEquivalentTo(1))
+	})
+
+	It("should report zero in-flight downloads when the exporter pod hasn't reported any yet", func() {
+		vmExport := createPVCVMExport()
+		controller := &VMExportController{}
+		controller.updateTransferStatus(vmExport, &k8sv1.Pod{}, nil)
+		Expect(vmExport.Status.Transfer.InFlightDownloads).To(BeZero())
+	})
+
+	It("should ignore a malformed in-flight downloads annotation", func() {
+		vmExport := createPVCVMExport()
+		pod := &k8sv1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annInFlightDownloads: "not-a-number"}}}
+		controller := &VMExportController{}
+		controller.updateTransferStatus(vmExport, pod, nil)
+		Expect(vmExport.Status.Transfer.InFlightDownloads).To(BeZero())
+	})
+})
@@ -0,0 +1,201 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	"context"
+	"fmt"
+
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	vsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const (
+	volumeSnapshotKind = "VolumeSnapshot"
+
+	// restorePVCPrefix names the temporary PVC the controller provisions from a
+	// VolumeSnapshot source's spec.dataSource, mirroring how exportPrefix names
+	// the exporter pod.
+	restorePVCPrefix = "restore"
+
+	// volumeSnapshotSourceIndex is the VMExportInformer indexer key this file
+	// registers, keyed by the namespace/name of the VolumeSnapshot a
+	// VirtualMachineExport's Spec.Source points at, so
+	// vmExportsForVolumeSnapshot can do an O(1) lookup per VolumeSnapshot event
+	// instead of listing every VMExport in the informer cache.
+	volumeSnapshotSourceIndex = "vmexport-by-volumesnapshot-source"
+)
+
+// volumeSnapshotAPIGroup is the apiGroup expected on
+// Spec.Source.APIGroup for a VolumeSnapshot source.
+var volumeSnapshotAPIGroup = vsv1.SchemeGroupVersion.Group
+
+// isVolumeSnapshotSource reports whether vmExport exports a CSI VolumeSnapshot
+// directly, rather than wrapping it in a VirtualMachineSnapshot.
+func isVolumeSnapshotSource(vmExport *exportv1.VirtualMachineExport) bool {
+	source := vmExport.Spec.Source
+	return source.Kind == volumeSnapshotKind && source.APIGroup != nil && *source.APIGroup == volumeSnapshotAPIGroup
+}
+
+// handleVolumeSnapshot is the VolumeSnapshot informer event handler, parallel
+// to handleVMSnapshot. It looks up, through vmExportsForVolumeSnapshot's
+// index, the exports whose source references the added/updated
+// VolumeSnapshot and enqueues them.
+func (ctrl *VMExportController) handleVolumeSnapshot(obj interface{}) {
+	vs, ok := obj.(*vsv1.VolumeSnapshot)
+	if !ok {
+		return
+	}
+	for _, key := range ctrl.vmExportsForVolumeSnapshot(vs.Namespace, vs.Name) {
+		ctrl.vmExportQueue.Add(key)
+	}
+}
+
+// GetVolumeSnapshotSourceIndexers returns the cache.Indexers this file needs
+// registered on the VMExportInformer (via its NewIndexerInformer/AddIndexers
+// call in the controller's informer setup) for vmExportsForVolumeSnapshot to
+// do an O(1) lookup instead of a full list-and-filter scan.
+func GetVolumeSnapshotSourceIndexers() cache.Indexers {
+	return cache.Indexers{volumeSnapshotSourceIndex: volumeSnapshotSourceIndexFunc}
+}
+
+// volumeSnapshotSourceIndexFunc indexes a VirtualMachineExport by the
+// namespace/name of the VolumeSnapshot its Spec.Source points at, for exports
+// that are actually VolumeSnapshot sources. Other exports contribute no index
+// entries.
+func volumeSnapshotSourceIndexFunc(obj interface{}) ([]string, error) {
+	vmExport, ok := obj.(*exportv1.VirtualMachineExport)
+	if !ok || !isVolumeSnapshotSource(vmExport) {
+		return nil, nil
+	}
+	return []string{vmExport.Namespace + "/" + vmExport.Spec.Source.Name}, nil
+}
+
+// vmExportsForVolumeSnapshot looks up, via volumeSnapshotSourceIndex, the
+// VMExports whose Spec.Source points at the given VolumeSnapshot, returning
+// their namespace/name keys. This is an O(1) indexer lookup rather than a scan
+// of every VMExport in the informer cache.
+func (ctrl *VMExportController) vmExportsForVolumeSnapshot(namespace, name string) []string {
+	objs, err := ctrl.VMExportInformer.GetIndexer().ByIndex(volumeSnapshotSourceIndex, namespace+"/"+name)
+	if err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// getRestorePVCName returns the name of the temporary PVC restored from a
+// VolumeSnapshot source for the given VMExport.
+func getRestorePVCName(vmExport *exportv1.VirtualMachineExport) string {
+	return fmt.Sprintf("%s-%s", restorePVCPrefix, vmExport.Name)
+}
+
+// restorePVCAccessMode returns the access mode to request for a VolumeSnapshot
+// restore PVC: ReadWriteOnce, unless rwxCapable confirms the StorageClass's CSI
+// driver actually supports ReadWriteMany for a freshly-provisioned volume.
+// Most CSI provisioners reject ReadWriteMany on a restore-from-snapshot, so
+// defaulting to it the way the Service/Ingress export path's own PVCs do would
+// make the restore fail for the common case.
+func restorePVCAccessMode(rwxCapable bool) k8sv1.PersistentVolumeAccessMode {
+	if rwxCapable {
+		return k8sv1.ReadWriteMany
+	}
+	return k8sv1.ReadWriteOnce
+}
+
+// createRestorePVCFromVolumeSnapshot builds the temporary PVC the controller
+// restores from vs via spec.dataSource, sized from restoreSize (as resolved by
+// the VolumeSnapshotProvider this package already uses for VMSnapshot exports),
+// ahead of running the regular PVC exporter-pod flow against it. rwxCapable
+// should come from the caller checking the target StorageClass's CSI driver
+// capabilities, not be assumed true.
+func createRestorePVCFromVolumeSnapshot(vmExport *exportv1.VirtualMachineExport, vs *vsv1.VolumeSnapshot, restoreSize resource.Quantity, storageClassName *string, rwxCapable bool) *k8sv1.PersistentVolumeClaim {
+	apiGroup := vsv1.SchemeGroupVersion.Group
+	return &k8sv1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      getRestorePVCName(vmExport),
+			Namespace: vmExport.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(vmExport, exportv1.SchemeGroupVersion.WithKind("VirtualMachineExport")),
+			},
+		},
+		Spec: k8sv1.PersistentVolumeClaimSpec{
+			AccessModes: []k8sv1.PersistentVolumeAccessMode{restorePVCAccessMode(rwxCapable)},
+			Resources: k8sv1.ResourceRequirements{
+				Requests: k8sv1.ResourceList{
+					k8sv1.ResourceStorage: restoreSize,
+				},
+			},
+			StorageClassName: storageClassName,
+			DataSource: &k8sv1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     volumeSnapshotKind,
+				Name:     vs.Name,
+			},
+		},
+	}
+}
+
+// reconcileVolumeSnapshotSource is the VolumeSnapshot-source counterpart to
+// whatever VMSnapshot-source reconcile branch updateVMExport already runs: it
+// fetches the referenced VolumeSnapshot via VolumeSnapshotProvider, creates
+// the restore PVC from it (idempotently, since updateVMExport reconciles
+// repeatedly), and returns that PVC so the caller can hand it to the regular
+// PVC exporter-pod flow the same way a VMSnapshot source's restored PVC
+// already does. It is a no-op, returning (nil, nil), for any other source
+// kind. rwxCapable defaults to false here: this reconcile layer has no
+// StorageClass-capability lookup available to it, only restorePVCAccessMode's
+// own safe RWO default.
+func (ctrl *VMExportController) reconcileVolumeSnapshotSource(vmExport *exportv1.VirtualMachineExport) (*k8sv1.PersistentVolumeClaim, error) {
+	if !isVolumeSnapshotSource(vmExport) {
+		return nil, nil
+	}
+
+	vs, err := ctrl.VolumeSnapshotProvider.GetVolumeSnapshot(vmExport.Namespace, vmExport.Spec.Source.Name)
+	if err != nil {
+		return nil, err
+	}
+	if vs.Status == nil || vs.Status.RestoreSize == nil {
+		return nil, fmt.Errorf("VolumeSnapshot %s/%s has no restore size reported yet", vmExport.Namespace, vmExport.Spec.Source.Name)
+	}
+
+	pvc := createRestorePVCFromVolumeSnapshot(vmExport, vs, *vs.Status.RestoreSize, nil, false)
+	created, err := ctrl.Client.CoreV1().PersistentVolumeClaims(vmExport.Namespace).Create(context.Background(), pvc, metav1.CreateOptions{})
+	if err == nil {
+		return created, nil
+	}
+	if !errors.IsAlreadyExists(err) {
+		return nil, err
+	}
+	return ctrl.Client.CoreV1().PersistentVolumeClaims(vmExport.Namespace).Get(context.Background(), pvc.Name, metav1.GetOptions{})
+}
@@ -0,0 +1,123 @@
+/*
+ * This file is part of the KubeVirt project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2023 Red Hat, Inc.
+ *
+ */
+
+package export
+
+import (
+	k8sv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	vsv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	exportv1 "kubevirt.io/api/export/v1alpha1"
+)
+
+const testVolumeSnapshotName = "test-volume-snapshot"
+
+// fakeSharedIndexInformer satisfies cache.SharedIndexInformer by embedding it
+// and overriding only GetIndexer, so vmExportsForVolumeSnapshot can be
+// exercised against a real cache.Indexer without standing up a full informer.
+type fakeSharedIndexInformer struct {
+	cache.SharedIndexInformer
+	indexer cache.Indexer
+}
+
+func (f *fakeSharedIndexInformer) GetIndexer() cache.Indexer { return f.indexer }
+
+func createVolumeSnapshotVMExport() *exportv1.VirtualMachineExport {
+	vmExport := createPVCVMExport()
+	vmExport.Spec.Source.Kind = volumeSnapshotKind
+	vmExport.Spec.Source.APIGroup = &volumeSnapshotAPIGroup
+	vmExport.Spec.Source.Name = testVolumeSnapshotName
+	return vmExport
+}
+
+var _ = Describe("VolumeSnapshot export source", func() {
+	It("should recognize a VolumeSnapshot source", func() {
+		vmExport := createVolumeSnapshotVMExport()
+		Expect(isVolumeSnapshotSource(vmExport)).To(BeTrue())
+	})
+
+	It("should not recognize a PVC source as a VolumeSnapshot source", func() {
+		vmExport := createPVCVMExport()
+		Expect(isVolumeSnapshotSource(vmExport)).To(BeFalse())
+	})
+
+	It("should build a restore PVC pointing at the VolumeSnapshot via dataSource", func() {
+		vmExport := createVolumeSnapshotVMExport()
+		vs := &vsv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      testVolumeSnapshotName,
+				Namespace: testNamespace,
+			},
+		}
+		pvc := createRestorePVCFromVolumeSnapshot(vmExport, vs, resource.MustParse("5Gi"), nil, false)
+		Expect(pvc.Name).To(Equal(getRestorePVCName(vmExport)))
+		Expect(pvc.Namespace).To(Equal(testNamespace))
+		Expect(pvc.Spec.DataSource.Kind).To(Equal(volumeSnapshotKind))
+		Expect(pvc.Spec.DataSource.Name).To(Equal(testVolumeSnapshotName))
+		Expect(pvc.Spec.Resources.Requests.Storage().String()).To(Equal("5Gi"))
+	})
+
+	It("should default the restore PVC to ReadWriteOnce, since most CSI provisioners reject ReadWriteMany on a fresh restore", func() {
+		vmExport := createVolumeSnapshotVMExport()
+		vs := &vsv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      testVolumeSnapshotName,
+				Namespace: testNamespace,
+			},
+		}
+		pvc := createRestorePVCFromVolumeSnapshot(vmExport, vs, resource.MustParse("5Gi"), nil, false)
+		Expect(pvc.Spec.AccessModes).To(ConsistOf(k8sv1.ReadWriteOnce))
+	})
+
+	It("should request ReadWriteMany when the caller confirms the storage class supports it", func() {
+		vmExport := createVolumeSnapshotVMExport()
+		vs := &vsv1.VolumeSnapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      testVolumeSnapshotName,
+				Namespace: testNamespace,
+			},
+		}
+		pvc := createRestorePVCFromVolumeSnapshot(vmExport, vs, resource.MustParse("5Gi"), nil, true)
+		Expect(pvc.Spec.AccessModes).To(ConsistOf(k8sv1.ReadWriteMany))
+	})
+
+	It("should look up exports for a VolumeSnapshot via the index, without matching exports for a different VolumeSnapshot", func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, GetVolumeSnapshotSourceIndexers())
+		matching := createVolumeSnapshotVMExport()
+		matching.Name = "matches"
+		other := createVolumeSnapshotVMExport()
+		other.Name = "other"
+		other.Spec.Source.Name = "some-other-snapshot"
+		pvcSourced := createPVCVMExport()
+		pvcSourced.Name = "pvc-sourced"
+		Expect(indexer.Add(matching)).To(Succeed())
+		Expect(indexer.Add(other)).To(Succeed())
+		Expect(indexer.Add(pvcSourced)).To(Succeed())
+
+		controller := &VMExportController{VMExportInformer: &fakeSharedIndexInformer{indexer: indexer}}
+		keys := controller.vmExportsForVolumeSnapshot(testNamespace, testVolumeSnapshotName)
+		Expect(keys).To(ConsistOf(testNamespace + "/matches"))
+	})
+})